@@ -3,30 +3,97 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/yuin/gopher-lua"
 )
 
-var (
-	windowMap  = make(map[string]*Window)
-	ansiRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
-)
+var ansiRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// updateApproved is set by the -update flag: when true, approve() writes
+// whatever it received as the new golden file instead of comparing to it.
+var updateApproved bool
 
 func removeANSIEscapeSequences(s string) string {
 	return ansiRegexp.ReplaceAllString(s, "")
 }
 
+// splitFlushedLine separates a line's raw accumulated bytes into the full
+// line (ANSI-stripped, for Peek) and the chunk still owed to the ring
+// buffer and hubs: everything after the flushed prefix an earlier idle
+// flush already published, also ANSI-stripped.
+func splitFlushedLine(raw string, flushed int) (full, chunk string) {
+	return removeANSIEscapeSequences(raw), removeANSIEscapeSequences(raw[flushed:])
+}
+
+// warnDroppedLines notes, on a timeout, that the subscriber's buffer
+// overflowed during the wait, so a script author can tell "nothing matched"
+// from "some lines never arrived because a burst outran the buffer".
+func warnDroppedLines(label string, dropped int64) {
+	if dropped > 0 {
+		fmt.Printf("%s: timed out after dropping %d line(s) from a full subscriber buffer; the match may have been missed, not just never produced (see droppedLines())\n", label, dropped)
+	}
+}
+
+// capturesToTable builds a 1-indexed Lua table of the subgroups captured by
+// a regexp match, skipping match[0] (the full match, which is not returned
+// to the script; callers return the match index in its place).
+func capturesToTable(L *lua.LState, match []string) *lua.LTable {
+	tbl := L.NewTable()
+	for i, group := range match[1:] {
+		tbl.RawSetInt(i+1, lua.LString(group))
+	}
+	return tbl
+}
+
+// windowRegistry tracks the tmux windows a single scenario run has
+// created, so shutdown can kill only that scenario's windows even when
+// other scenarios are running concurrently (e.g. in -d discovery mode).
+type windowRegistry struct {
+	mu      sync.Mutex
+	windows map[string]*Window
+}
+
+func newWindowRegistry() *windowRegistry {
+	return &windowRegistry{windows: make(map[string]*Window)}
+}
+
+func (r *windowRegistry) set(name string, w *Window) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.windows[name] = w
+}
+
+func (r *windowRegistry) get(name string) *Window {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.windows[name]
+}
+
+func (r *windowRegistry) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.windows))
+	for name := range r.windows {
+		names = append(names, name)
+	}
+	return names
+}
+
 type Window struct {
 	name      string
 	command   string
@@ -72,7 +139,7 @@ func (w Window) Start() error {
 	}
 	_, _ = os.Create(w.LogPath())
 
-	w.watcher.AddFilePath(w.LogPath())
+	w.watcher.AddFilePath(w.LogPath(), w.name)
 	return nil
 }
 
@@ -80,22 +147,347 @@ func (w Window) SendCommand(command string) {
 	_ = exec.Command("tmux", "send-keys", "-t", w.name, command, "C-m").Run()
 }
 
+// lineHub fans a stream of lines out to any number of concurrent subscribers.
+// Each subscriber gets its own buffered channel so a slow or idle reader
+// can't block delivery to the others; a full subscriber drops the line
+// rather than stalling the publisher, and the drop is counted so callers
+// can tell a genuine no-match timeout from lines lost to a burst (see
+// LineWatcher.DroppedLines and the droppedLines() Lua builtin).
+type lineHub struct {
+	mu      sync.Mutex
+	subs    map[int]chan string
+	next    int
+	dropped int64
+}
+
+func newLineHub() *lineHub {
+	return &lineHub{subs: make(map[int]chan string)}
+}
+
+func (h *lineHub) subscribe() (int, <-chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.next
+	h.next++
+	ch := make(chan string, 64)
+	h.subs[id] = ch
+	return id, ch
+}
+
+func (h *lineHub) unsubscribe(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.subs[id]; ok {
+		delete(h.subs, id)
+		close(ch)
+	}
+}
+
+func (h *lineHub) publish(line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.subs {
+		select {
+		case ch <- line:
+		default:
+			h.dropped++
+		}
+	}
+}
+
+// droppedCount returns how many lines this hub has discarded because a
+// subscriber's buffer was full when they were published.
+func (h *lineHub) droppedCount() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+// filePathEntry associates a pipe-pane log with the window it belongs to, so
+// lines read from it can be tagged and routed to that window's subscribers.
+type filePathEntry struct {
+	path       string
+	windowName string
+}
+
+// defaultIdleFlush is how long watchFileLines waits after the last byte of
+// an unterminated line before publishing it anyway. This lets expect match
+// prompts like "password:" that never end in a newline.
+const defaultIdleFlush = 100 * time.Millisecond
+
+// idleFlush is set by the -idle-flush flag and seeds every LineWatcher's
+// idle-flush delay; it defaults to defaultIdleFlush.
+var idleFlush = defaultIdleFlush
+
+// defaultRefreshEvery is the poll-fallback interval used to detect log
+// rotation/truncation on filesystems (NFS, some containers) where fsnotify
+// doesn't reliably deliver events.
+const defaultRefreshEvery = 2 * time.Second
+
+// refreshEvery is set by the -refresh-every flag and seeds every
+// LineWatcher's poll-fallback interval; it defaults to defaultRefreshEvery.
+var refreshEvery = defaultRefreshEvery
+
+// defaultRingSize bounds how many lines approve()'s per-window ring buffer
+// retains since the last reset, so a chatty window can't grow it unbounded.
+const defaultRingSize = 2000
+
+// ringSize is set by the -ring-size flag and seeds every LineWatcher's
+// per-window ring buffer capacity; it defaults to defaultRingSize.
+var ringSize = defaultRingSize
+
+// errRotated is returned internally by watchFileLinesOnce to tell
+// watchFileLines that the log file was rotated, truncated, or recreated
+// and should be reopened from scratch.
+var errRotated = errors.New("texpect: log file rotated")
+
+// openRetryMinDelay and openRetryMaxDelay bound the backoff openWithRetry
+// uses while waiting for a rotated log file's replacement to show up.
+const (
+	openRetryMinDelay = 50 * time.Millisecond
+	openRetryMaxDelay = 2 * time.Second
+)
+
+// openWithRetry opens filePath, retrying with exponential backoff while the
+// file doesn't exist yet. Log rotation typically renames-then-recreates the
+// path, so the replacement can be briefly absent; without a retry here, a
+// watcher that wakes up in that gap dies instead of surviving the rotation.
+// It gives up and returns ctx.Err() once ctx is cancelled.
+func openWithRetry(ctx context.Context, filePath string) (*os.File, error) {
+	delay := openRetryMinDelay
+	for {
+		file, err := os.Open(filePath)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		if delay *= 2; delay > openRetryMaxDelay {
+			delay = openRetryMaxDelay
+		}
+	}
+}
+
 type LineWatcher struct {
-	filePathCh chan string
-	recvLineCh chan string
+	filePathCh chan filePathEntry
 	ctx        context.Context
+
+	globalHub *lineHub
+
+	hubMu      sync.Mutex
+	windowHubs map[string]*lineHub
+
+	lastMu   sync.Mutex
+	lastLine map[string]string
+
+	reopenMu  sync.Mutex
+	reopenChs map[string]chan struct{}
+
+	ringMu   sync.Mutex
+	rings    map[string][]string
+	ringSize int
+
+	closeOnce sync.Once
+
+	idleFlush    time.Duration
+	refreshEvery time.Duration
 }
 
 func NewLineWatcher(ctx context.Context) *LineWatcher {
 	return &LineWatcher{
-		filePathCh: make(chan string),
-		recvLineCh: make(chan string),
-		ctx:        ctx,
+		filePathCh:   make(chan filePathEntry),
+		ctx:          ctx,
+		globalHub:    newLineHub(),
+		windowHubs:   make(map[string]*lineHub),
+		lastLine:     make(map[string]string),
+		reopenChs:    make(map[string]chan struct{}),
+		rings:        make(map[string][]string),
+		ringSize:     ringSize,
+		idleFlush:    idleFlush,
+		refreshEvery: refreshEvery,
 	}
 }
 
-func (l *LineWatcher) AddFilePath(filePath string) {
-	l.filePathCh <- filePath
+// reopenSignal returns the channel used to tell the goroutine watching
+// windowName's log to reopen it immediately, creating it on first use.
+func (l *LineWatcher) reopenSignal(windowName string) chan struct{} {
+	l.reopenMu.Lock()
+	defer l.reopenMu.Unlock()
+	ch, ok := l.reopenChs[windowName]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.reopenChs[windowName] = ch
+	}
+	return ch
+}
+
+// Reopen forces the log for windowName to be closed and reopened from the
+// start, for scripts that intentionally rotate a window's log file.
+func (l *LineWatcher) Reopen(windowName string) {
+	select {
+	case l.reopenSignal(windowName) <- struct{}{}:
+	default:
+	}
+}
+
+// fileState is the (inode, size, modtime) record used to notice that a log
+// path now refers to a different, truncated, or shrunk file.
+type fileState struct {
+	ino     uint64
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) (fileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+	return fileState{ino: ino, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// rotated reports whether newState describes a different underlying file
+// than oldState: a changed inode, or a size that shrank (truncation). A
+// size that only grew isn't a rotation, just more data to read.
+func rotated(oldState, newState fileState) bool {
+	return newState.ino != oldState.ino || newState.size < oldState.size
+}
+
+func (l *LineWatcher) AddFilePath(filePath, windowName string) {
+	l.filePathCh <- filePathEntry{path: filePath, windowName: windowName}
+}
+
+// Close stops intake of new log paths so watchLatestLine can drain its
+// goroutines and return. Safe to call more than once.
+func (l *LineWatcher) Close() {
+	l.closeOnce.Do(func() {
+		close(l.filePathCh)
+	})
+}
+
+// Flush writes the most recently seen line of every tracked window to w,
+// so nothing is lost when the program is about to exit.
+func (l *LineWatcher) Flush(w io.Writer) {
+	l.lastMu.Lock()
+	defer l.lastMu.Unlock()
+	for windowName, line := range l.lastLine {
+		fmt.Fprintf(w, "[%s] %s", windowName, line)
+		if !strings.HasSuffix(line, "\n") {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func (l *LineWatcher) windowHub(windowName string) *lineHub {
+	l.hubMu.Lock()
+	defer l.hubMu.Unlock()
+	hub, ok := l.windowHubs[windowName]
+	if !ok {
+		hub = newLineHub()
+		l.windowHubs[windowName] = hub
+	}
+	return hub
+}
+
+// Subscribe registers for every line seen across all windows, matching the
+// historical behaviour of expect/expectAny.
+func (l *LineWatcher) Subscribe() (int, <-chan string) {
+	return l.globalHub.subscribe()
+}
+
+func (l *LineWatcher) Unsubscribe(id int) {
+	l.globalHub.unsubscribe(id)
+}
+
+// SubscribeWindow registers for lines from a single window only, so a
+// waiter on one window can't have its lines stolen by a waiter on another.
+func (l *LineWatcher) SubscribeWindow(windowName string) (int, <-chan string) {
+	return l.windowHub(windowName).subscribe()
+}
+
+func (l *LineWatcher) UnsubscribeWindow(windowName string, id int) {
+	l.windowHub(windowName).unsubscribe(id)
+}
+
+// DroppedLines returns how many lines have been discarded because a
+// subscriber's 64-line buffer was still full of unread lines when a new one
+// arrived: the drops of windowName's own subscribers plus those of the
+// all-window subscribers (expect, expectAny, expectRegex, expectAnyRegex),
+// whose count covers lines from every window, not only windowName's.
+// A non-zero count during a wait means the expect-family
+// call could have missed the pattern it was looking for rather than it
+// never appearing, which is otherwise indistinguishable from a real timeout.
+func (l *LineWatcher) DroppedLines(windowName string) int64 {
+	return l.globalHub.droppedCount() + l.windowHub(windowName).droppedCount()
+}
+
+// Peek returns the most recently observed line for windowName without
+// waiting for a new one: the whole line if it ended in a newline, or
+// everything read so far if it's an unterminated line sitting in an idle
+// flush. ok is false if no line has been seen yet.
+func (l *LineWatcher) Peek(windowName string) (line string, ok bool) {
+	l.lastMu.Lock()
+	defer l.lastMu.Unlock()
+	line, ok = l.lastLine[windowName]
+	return
+}
+
+// publishLine records fullLine (the complete line as read so far, even if
+// it's an idle-flushed partial with no newline yet) for Peek, and fans chunk
+// out to the ring buffer and both hubs. Callers (watchFileLinesOnce) must
+// pass fullLine as the whole accumulated line, but chunk as only the
+// unflushed remainder, never bytes already published by an earlier idle
+// flush, or approve()'s Snapshot would see a partial prompt twice.
+func (l *LineWatcher) publishLine(windowName, fullLine, chunk string) {
+	l.lastMu.Lock()
+	l.lastLine[windowName] = fullLine
+	l.lastMu.Unlock()
+
+	l.appendRing(windowName, chunk)
+
+	l.globalHub.publish(chunk)
+	l.windowHub(windowName).publish(chunk)
+}
+
+func (l *LineWatcher) appendRing(windowName, line string) {
+	l.ringMu.Lock()
+	defer l.ringMu.Unlock()
+	lines := append(l.rings[windowName], line)
+	if len(lines) > l.ringSize {
+		lines = lines[len(lines)-l.ringSize:]
+	}
+	l.rings[windowName] = lines
+}
+
+// Snapshot returns windowName's accumulated, ANSI-stripped log lines since
+// the buffer was last cleared by Reset, joined back into one string. Only
+// the newest ringSize entries are kept; older ones are no longer included.
+func (l *LineWatcher) Snapshot(windowName string) string {
+	l.ringMu.Lock()
+	defer l.ringMu.Unlock()
+	return strings.Join(l.rings[windowName], "")
+}
+
+// Reset clears windowName's accumulated log buffer, for scripts that want
+// to mark a phase boundary between approve() calls.
+func (l *LineWatcher) Reset(windowName string) {
+	l.ringMu.Lock()
+	defer l.ringMu.Unlock()
+	delete(l.rings, windowName)
 }
 
 func (l *LineWatcher) watchLatestLine() error {
@@ -105,16 +497,16 @@ func (l *LineWatcher) watchLatestLine() error {
 
 	for {
 		select {
-		case path, ok := <-l.filePathCh:
+		case entry, ok := <-l.filePathCh:
 			if !ok {
 				wg.Wait()
 				return nil
 			}
 			wg.Add(1)
-			go func(p string) {
+			go func(e filePathEntry) {
 				defer wg.Done()
-				_ = l.watchFileLines(ctx, p)
-			}(path)
+				_ = l.watchFileLines(ctx, e.path, e.windowName)
+			}(entry)
 		case <-ctx.Done():
 			wg.Wait()
 			return nil
@@ -122,74 +514,528 @@ func (l *LineWatcher) watchLatestLine() error {
 	}
 }
 
-func (l *LineWatcher) watchFileLines(ctx context.Context, filePath string) error {
-
-	watcher, _ := fsnotify.NewWatcher()
-	defer watcher.Close()
-	watcher.Add(filePath)
+// watchFileLines keeps (re)opening filePath for as long as ctx is alive,
+// restarting from scratch whenever watchFileLinesOnce reports the file was
+// rotated, truncated, or recreated out from under it.
+func (l *LineWatcher) watchFileLines(ctx context.Context, filePath, windowName string) error {
+	reopen := l.reopenSignal(windowName)
+	seekToEnd := true
+	for {
+		err := l.watchFileLinesOnce(ctx, filePath, windowName, reopen, seekToEnd)
+		if err == nil {
+			return nil
+		}
+		if err != errRotated {
+			if ctx.Err() != nil {
+				// openWithRetry gave up because ctx was cancelled while
+				// waiting for a replacement file to appear; that's a
+				// shutdown, not a real failure.
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		// A rotated/recreated file is read from the start, not the end,
+		// since whatever replaced it hasn't been seen yet.
+		seekToEnd = false
+	}
+}
 
-	file, _ := os.Open(filePath)
+func (l *LineWatcher) watchFileLinesOnce(ctx context.Context, filePath, windowName string, reopen <-chan struct{}, seekToEnd bool) error {
+	// Open before watching: Add on a path that doesn't exist yet is a
+	// no-op on most platforms, and during rotation the replacement file
+	// can briefly be absent, so opening first (with retry) guarantees the
+	// watch is registered against a path that actually exists.
+	file, err := openWithRetry(ctx, filePath)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
-	_, err := file.Seek(0, io.SeekEnd)
+
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
+	defer watcher.Close()
+	watcher.Add(filePath)
+
+	if seekToEnd {
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	state, _ := statFile(filePath)
 
 	reader := bufio.NewReader(file)
 	var line strings.Builder
+	// flushed is how many bytes of the in-progress line were already
+	// published by an idle flush, so the eventual newline (or the next
+	// idle tick) only publishes the unflushed remainder instead of
+	// re-publishing the whole accumulated buffer.
+	flushed := 0
+
+	// idleTimer fires when bytes have stopped arriving for a partial line,
+	// so that prompts with no trailing newline still reach expect/match.
+	idleTimer := time.NewTimer(l.idleFlush)
+	if !idleTimer.Stop() {
+		<-idleTimer.C
+	}
+	defer idleTimer.Stop()
+
+	drainAvailable := func() {
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				break
+			}
+			line.WriteByte(b)
+
+			if b == '\n' {
+				full, chunk := splitFlushedLine(line.String(), flushed)
+				l.publishLine(windowName, full, chunk)
+				line.Reset()
+				flushed = 0
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+			} else {
+				idleTimer.Reset(l.idleFlush)
+			}
+		}
+	}
+
+	// refreshTicker is the poll fallback: it notices rotation/truncation
+	// and picks up missed writes on filesystems where fsnotify is unreliable.
+	refreshTicker := time.NewTicker(l.refreshEvery)
+	defer refreshTicker.Stop()
+
+	checkForRotation := func() bool {
+		newState, err := statFile(filePath)
+		if err != nil {
+			return true
+		}
+		if rotated(state, newState) {
+			return true
+		}
+		if newState.size > state.size {
+			drainAvailable()
+		}
+		state = newState
+		return false
+	}
+
 	for {
 		select {
 		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				for {
-					b, err := reader.ReadByte()
-					if err != nil {
-						break
-					}
-					line.WriteByte(b)
-
-					if b == '\n' {
-						l.recvLineCh <- removeANSIEscapeSequences(line.String())
-						line.Reset()
-					}
+			switch {
+			case event.Op&fsnotify.Write == fsnotify.Write:
+				drainAvailable()
+				if s, err := statFile(filePath); err == nil {
+					state = s
+				}
+			case event.Op&(fsnotify.Rename|fsnotify.Remove) != 0:
+				return errRotated
+			case event.Op&fsnotify.Chmod != 0:
+				// fsnotify reports Chmod for benign attribute changes
+				// (e.g. logrotate's chmod/chown of the live file) on the
+				// same inode, not just real rotation. Only treat it as a
+				// rotation if the inode actually changed or the file
+				// shrank; otherwise keep reading from the current offset.
+				if checkForRotation() {
+					return errRotated
 				}
 			}
+		case <-refreshTicker.C:
+			if checkForRotation() {
+				return errRotated
+			}
+		case <-reopen:
+			return errRotated
 		case err := <-watcher.Errors:
 			return err
+		case <-idleTimer.C:
+			if line.Len() > flushed {
+				full, chunk := splitFlushedLine(line.String(), flushed)
+				l.publishLine(windowName, full, chunk)
+				flushed = line.Len()
+			}
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (l *LineWatcher) GetLineCh() <-chan string {
-	return l.recvLineCh
-}
-
-func (l *LineWatcher) Watch() {
+// Watch starts the watcher and returns a channel that's closed once every
+// watchFileLines goroutine it spawned has returned (after Close, or after
+// ctx is cancelled).
+func (l *LineWatcher) Watch() <-chan struct{} {
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		if err := l.watchLatestLine(); err != nil {
 			fmt.Println("Error watching files:", err)
-			return
 		}
 	}()
+	return done
+}
+
+// shutdownCoordinator cancels a scenario's context, waits for its
+// LineWatcher to drain, and kills only the tmux windows it created. It
+// runs at most once, whether triggered by an OS signal or by the Lua
+// exit() builtin, and every call returns the code the first caller gave it.
+type shutdownCoordinator struct {
+	once         sync.Once
+	cancel       context.CancelFunc
+	drainDone    <-chan struct{}
+	drainTimeout time.Duration
+	windows      *windowRegistry
+	exitCode     int
+}
+
+func newShutdownCoordinator(cancel context.CancelFunc, drainDone <-chan struct{}, windows *windowRegistry) *shutdownCoordinator {
+	return &shutdownCoordinator{
+		cancel:       cancel,
+		drainDone:    drainDone,
+		drainTimeout: 5 * time.Second,
+		windows:      windows,
+	}
+}
+
+func (s *shutdownCoordinator) cleanup(code int) int {
+	s.once.Do(func() {
+		s.cancel()
+
+		select {
+		case <-s.drainDone:
+		case <-time.After(s.drainTimeout):
+		}
+
+		for _, name := range s.windows.names() {
+			exec.Command("tmux", "kill-window", "-t", name).Run()
+		}
+
+		s.exitCode = code
+	})
+	return s.exitCode
+}
+
+// scenario bundles everything isolated to one running Lua script: its own
+// window registry, LineWatcher, and shutdown coordinator, so several
+// scenarios (e.g. under -d discovery) can run concurrently without
+// stepping on each other's tmux windows or log watches.
+type scenario struct {
+	name       string
+	scriptBase string
+
+	windows     *windowRegistry
+	watcher     *LineWatcher
+	coordinator *shutdownCoordinator
+
+	doneCh   chan struct{}
+	doneOnce sync.Once
+
+	mu       sync.Mutex
+	exited   bool
+	exitCode int
+}
+
+func newScenario(name string) *scenario {
+	ctx, cancel := context.WithCancel(context.Background())
+	windows := newWindowRegistry()
+	watcher := NewLineWatcher(ctx)
+	drainDone := watcher.Watch()
+
+	return &scenario{
+		name:        name,
+		windows:     windows,
+		watcher:     watcher,
+		coordinator: newShutdownCoordinator(cancel, drainDone, windows),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+// Done returns a channel that's closed once terminate has been called, so
+// that goroutines blocked waiting on this scenario's output (e.g. a Lua
+// script parked in expect) can unblock instead of leaking when the
+// scenario is torn down out from under them, as happens on -d hot reload.
+func (s *scenario) Done() <-chan struct{} {
+	return s.doneCh
+}
+
+// terminate records the scenario's outcome and tears down its tmux windows
+// and log watches, without touching the rest of the process.
+func (s *scenario) terminate(code int) {
+	code = s.coordinator.cleanup(code)
+	s.mu.Lock()
+	s.exited = true
+	s.exitCode = code
+	s.mu.Unlock()
+	s.doneOnce.Do(func() { close(s.doneCh) })
+}
+
+func (s *scenario) result() (code int, exited bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exitCode, s.exited
+}
+
+var (
+	scenariosMu sync.Mutex
+	scenarios   = make(map[*scenario]struct{})
+)
+
+func registerScenario(s *scenario) {
+	scenariosMu.Lock()
+	scenarios[s] = struct{}{}
+	scenariosMu.Unlock()
+}
+
+func unregisterScenario(s *scenario) {
+	scenariosMu.Lock()
+	delete(scenarios, s)
+	scenariosMu.Unlock()
+}
+
+// shutdownAllScenarios terminates every running scenario (killing only the
+// tmux windows each one created) and then exits the whole process. This is
+// what the SIGINT/SIGTERM/SIGHUP handler in main calls.
+func shutdownAllScenarios(code int) {
+	scenariosMu.Lock()
+	all := make([]*scenario, 0, len(scenarios))
+	for s := range scenarios {
+		all = append(all, s)
+	}
+	scenariosMu.Unlock()
+
+	for _, s := range all {
+		s.terminate(code)
+	}
+	os.Exit(code)
+}
+
+// runScenario reads and runs a single Lua scenario file to completion in
+// its own Lua state and scenario (window registry + LineWatcher). It
+// passes if the script called exit(0) or ran off the end without error;
+// otherwise it fails, reporting the script's exit() code, 1 for an
+// approve() mismatch, or -1. onStart,
+// if non-nil, is called with the scenario as soon as it's created, so a
+// caller can track it (e.g. to support hot-reload teardown) before the
+// script has necessarily finished running.
+func runScenario(name, path string, onStart func(*scenario)) (exitCode int) {
+	scriptData, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Failed to read scenario %s: %v\n", name, err)
+		return -1
+	}
+
+	s := newScenario(name)
+	s.scriptBase = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	registerScenario(s)
+	defer unregisterScenario(s)
+	if onStart != nil {
+		onStart(s)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+
+	registerAPI(L, s)
+
+	err = L.DoString(string(scriptData))
+
+	if code, exited := s.result(); exited {
+		return code
+	}
+	if err != nil {
+		fmt.Printf("Scenario %s error: %v\n", name, err)
+		return -1
+	}
+	return 0
+}
+
+// diffLines renders a simple unified-style diff between two line slices via
+// an LCS alignment: shared lines get a leading space, lines only in old get
+// '-', lines only in new get '+'.
+func diffLines(oldLines, newLines []string) string {
+	n, m := len(oldLines), len(newLines)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var b strings.Builder
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case oldLines[i] == newLines[j]:
+			fmt.Fprintf(&b, "  %s\n", oldLines[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&b, "- %s\n", oldLines[i])
+			i++
+		default:
+			fmt.Fprintf(&b, "+ %s\n", newLines[j])
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		fmt.Fprintf(&b, "- %s\n", oldLines[i])
+	}
+	for ; j < m; j++ {
+		fmt.Fprintf(&b, "+ %s\n", newLines[j])
+	}
+	return b.String()
+}
+
+// scenarioReport is the per-scenario outcome printed by -report json|tap.
+type scenarioReport struct {
+	Name string `json:"name"`
+	Pass bool   `json:"pass"`
+	Code int    `json:"code"`
+}
+
+func printReport(format string, seq int, r scenarioReport) {
+	switch format {
+	case "json":
+		fmt.Printf(`{"name":%q,"pass":%t,"code":%d}`+"\n", r.Name, r.Pass, r.Code)
+	default: // tap
+		if r.Pass {
+			fmt.Printf("ok %d - %s\n", seq, r.Name)
+		} else {
+			fmt.Printf("not ok %d - %s (exit %d)\n", seq, r.Name, r.Code)
+		}
+	}
+}
+
+// runDiscovery discovers *.lua scenarios under dir and runs each in its own
+// isolated scenario, reporting pass/fail as it goes. It then watches dir
+// for changes: a modified or newly created scenario is (re-)run, and a
+// removed scenario has its tmux windows torn down.
+func runDiscovery(dir, reportFormat string) {
+	dirWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("Failed to watch scenario directory: %v\n", err)
+		os.Exit(1)
+	}
+	defer dirWatcher.Close()
+	if err := dirWatcher.Add(dir); err != nil {
+		fmt.Printf("Failed to watch scenario directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	var seqMu sync.Mutex
+	seq := 0
+	report := func(name string, code int) {
+		seqMu.Lock()
+		seq++
+		n := seq
+		seqMu.Unlock()
+		printReport(reportFormat, n, scenarioReport{Name: name, Pass: code == 0, Code: code})
+	}
+
+	var runningMu sync.Mutex
+	running := make(map[string]*scenario)
+
+	runFile := func(path string) {
+		name := filepath.Base(path)
+
+		runningMu.Lock()
+		if prev, ok := running[path]; ok {
+			prev.terminate(-1)
+		}
+		runningMu.Unlock()
+
+		go func() {
+			var mine *scenario
+			code := runScenario(name, path, func(s *scenario) {
+				mine = s
+				runningMu.Lock()
+				running[path] = s
+				runningMu.Unlock()
+			})
+
+			runningMu.Lock()
+			if running[path] == mine {
+				delete(running, path)
+			}
+			runningMu.Unlock()
+
+			report(name, code)
+		}()
+	}
+
+	teardownFile := func(path string) {
+		runningMu.Lock()
+		s, ok := running[path]
+		if ok {
+			delete(running, path)
+		}
+		runningMu.Unlock()
+		if ok {
+			s.terminate(-1)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Printf("Failed to read scenario directory: %v\n", err)
+		os.Exit(1)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".lua") {
+			continue
+		}
+		runFile(filepath.Join(dir, entry.Name()))
+	}
+
+	for event := range dirWatcher.Events {
+		if !strings.HasSuffix(event.Name, ".lua") {
+			continue
+		}
+		switch {
+		case event.Op&(fsnotify.Write|fsnotify.Create) != 0:
+			runFile(event.Name)
+		case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			teardownFile(event.Name)
+		}
+	}
 }
 
 func main() {
 	var chooseTree bool
 	var scriptFile string
+	var scenarioDir string
+	var reportFormat string
 	flag.StringVar(&scriptFile, "f", "", "Path to Lua script file")
 	flag.BoolVar(&chooseTree, "t", false, "Open tmux choose-tree")
+	flag.StringVar(&scenarioDir, "d", "", "Directory of .lua scenarios to discover and run")
+	flag.StringVar(&reportFormat, "report", "tap", "Scenario report format: json or tap")
+	flag.BoolVar(&updateApproved, "update", false, "Write approve() output as the new golden file instead of comparing to it")
+	flag.DurationVar(&idleFlush, "idle-flush", defaultIdleFlush, "How long to wait after the last byte of an unterminated line before publishing it anyway")
+	flag.DurationVar(&refreshEvery, "refresh-every", defaultRefreshEvery, "Poll-fallback interval for detecting log rotation/truncation fsnotify might miss")
+	flag.IntVar(&ringSize, "ring-size", defaultRingSize, "How many lines approve()'s per-window ring buffer retains since the last reset")
 	flag.Parse()
 
-	if scriptFile == "" {
-		fmt.Println("Usage: texpect -f script.lua")
-		os.Exit(1)
-	}
-
-	scriptData, err := os.ReadFile(scriptFile)
-	if err != nil {
-		fmt.Printf("Failed to read script file: %v\n", err)
+	if scriptFile == "" && scenarioDir == "" {
+		fmt.Println("Usage: texpect -f script.lua | texpect -d scenarios/")
 		os.Exit(1)
 	}
 
@@ -197,23 +1043,26 @@ func main() {
 		exec.Command("tmux", "choose-tree").Run()
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	lineWatcher := NewLineWatcher(ctx)
-	lineWatcher.Watch()
-
-	L := lua.NewState()
-	defer L.Close()
-
-	registerAPI(L, lineWatcher)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigCh
+		fmt.Printf("\nReceived %s, shutting down...\n", sig)
+		shutdownAllScenarios(1)
+	}()
 
-	if err := L.DoString(string(scriptData)); err != nil {
-		fmt.Printf("Lua script execution error: %v\n", err)
+	if scenarioDir != "" {
+		runDiscovery(scenarioDir, reportFormat)
+		return
 	}
+
+	os.Exit(runScenario(filepath.Base(scriptFile), scriptFile, nil))
 }
 
-func registerAPI(L *lua.LState, watcher *LineWatcher) {
+func registerAPI(L *lua.LState, s *scenario) {
+	watcher := s.watcher
+	var onExitMu sync.Mutex
+	var onExitFns []*lua.LFunction
 	//-------------------------------------------------------------------------
 	// spawn
 	//-------------------------------------------------------------------------
@@ -226,7 +1075,7 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 			L.RaiseError("Failed to create window: %v", err)
 			return 0
 		}
-		windowMap[windowName] = win
+		s.windows.set(windowName, win)
 
 		return 0
 	}))
@@ -239,7 +1088,7 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 		command := L.CheckString(2)
 		fmt.Printf("send('%s', '%s')\n", windowName, command)
 
-		win := windowMap[windowName]
+		win := s.windows.get(windowName)
 		win.SendCommand(command)
 
 		return 0
@@ -257,16 +1106,24 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 			fmt.Printf("expect('%s', '%d')\n", expectedText, timeout)
 		}
 
+		id, lineCh := watcher.Subscribe()
+		defer watcher.Unsubscribe(id)
+		droppedBefore := watcher.globalHub.droppedCount()
+
 		timeoutCh := time.After(time.Duration(timeout) * time.Second)
 
 		for {
 			select {
-			case line := <-watcher.GetLineCh():
+			case line := <-lineCh:
 				if strings.Contains(line, expectedText) {
 					L.Push(lua.LNumber(0))
 					return 1
 				}
 			case <-timeoutCh:
+				warnDroppedLines(fmt.Sprintf("expect('%s')", expectedText), watcher.globalHub.droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
 				L.Push(lua.LNumber(-1))
 				return 1
 			}
@@ -285,11 +1142,15 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 			expectedTexts = append(expectedTexts, v.String())
 		})
 
+		id, lineCh := watcher.Subscribe()
+		defer watcher.Unsubscribe(id)
+		droppedBefore := watcher.globalHub.droppedCount()
+
 		timeoutCh := time.After(time.Duration(timeout) * time.Second)
 
 		for {
 			select {
-			case line := <-watcher.GetLineCh():
+			case line := <-lineCh:
 				for index, expectedText := range expectedTexts {
 					if strings.Contains(line, expectedText) {
 						L.Push(lua.LNumber(index))
@@ -297,12 +1158,296 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 					}
 				}
 			case <-timeoutCh:
+				warnDroppedLines("expectAny(...)", watcher.globalHub.droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
+				L.Push(lua.LNumber(-1))
+				return 1
+			}
+		}
+	}))
+
+	//-------------------------------------------------------------------------
+	// expectOn
+	//-------------------------------------------------------------------------
+	L.SetGlobal("expectOn", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		expectedText := L.CheckString(2)
+		timeout := L.OptInt(3, math.MaxInt)
+		fmt.Printf("expectOn('%s', '%s')\n", windowName, expectedText)
+
+		id, lineCh := watcher.SubscribeWindow(windowName)
+		defer watcher.UnsubscribeWindow(windowName, id)
+		droppedBefore := watcher.windowHub(windowName).droppedCount()
+
+		timeoutCh := time.After(time.Duration(timeout) * time.Second)
+
+		for {
+			select {
+			case line := <-lineCh:
+				if strings.Contains(line, expectedText) {
+					L.Push(lua.LNumber(0))
+					return 1
+				}
+			case <-timeoutCh:
+				warnDroppedLines(fmt.Sprintf("expectOn('%s', '%s')", windowName, expectedText), watcher.windowHub(windowName).droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
+				L.Push(lua.LNumber(-1))
+				return 1
+			}
+		}
+	}))
+
+	//-------------------------------------------------------------------------
+	// expectAnyOn
+	//-------------------------------------------------------------------------
+	L.SetGlobal("expectAnyOn", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		tbl := L.CheckTable(2)
+		timeout := L.OptInt(3, math.MaxInt)
+
+		expectedTexts := []string{}
+		tbl.ForEach(func(_, v lua.LValue) {
+			expectedTexts = append(expectedTexts, v.String())
+		})
+
+		id, lineCh := watcher.SubscribeWindow(windowName)
+		defer watcher.UnsubscribeWindow(windowName, id)
+		droppedBefore := watcher.windowHub(windowName).droppedCount()
+
+		timeoutCh := time.After(time.Duration(timeout) * time.Second)
+
+		for {
+			select {
+			case line := <-lineCh:
+				for index, expectedText := range expectedTexts {
+					if strings.Contains(line, expectedText) {
+						L.Push(lua.LNumber(index))
+						return 1
+					}
+				}
+			case <-timeoutCh:
+				warnDroppedLines(fmt.Sprintf("expectAnyOn('%s', ...)", windowName), watcher.windowHub(windowName).droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
 				L.Push(lua.LNumber(-1))
 				return 1
 			}
 		}
 	}))
 
+	//-------------------------------------------------------------------------
+	// expectRegex
+	//-------------------------------------------------------------------------
+	L.SetGlobal("expectRegex", L.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		timeout := L.OptInt(2, math.MaxInt)
+		fmt.Printf("expectRegex('%s')\n", pattern)
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			L.RaiseError("invalid regex %q: %v", pattern, err)
+			return 0
+		}
+
+		id, lineCh := watcher.Subscribe()
+		defer watcher.Unsubscribe(id)
+		droppedBefore := watcher.globalHub.droppedCount()
+
+		timeoutCh := time.After(time.Duration(timeout) * time.Second)
+
+		for {
+			select {
+			case line := <-lineCh:
+				if m := re.FindStringSubmatch(line); m != nil {
+					L.Push(lua.LNumber(0))
+					L.Push(capturesToTable(L, m))
+					return 2
+				}
+			case <-timeoutCh:
+				warnDroppedLines(fmt.Sprintf("expectRegex('%s')", pattern), watcher.globalHub.droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
+				L.Push(lua.LNumber(-1))
+				return 1
+			}
+		}
+	}))
+
+	//-------------------------------------------------------------------------
+	// expectAnyRegex
+	//-------------------------------------------------------------------------
+	L.SetGlobal("expectAnyRegex", L.NewFunction(func(L *lua.LState) int {
+		tbl := L.CheckTable(1)
+		timeout := L.OptInt(2, math.MaxInt)
+
+		patterns := []*regexp.Regexp{}
+		var compileErr error
+		tbl.ForEach(func(_, v lua.LValue) {
+			if compileErr != nil {
+				return
+			}
+			re, err := regexp.Compile(v.String())
+			if err != nil {
+				compileErr = err
+				return
+			}
+			patterns = append(patterns, re)
+		})
+		if compileErr != nil {
+			L.RaiseError("invalid regex: %v", compileErr)
+			return 0
+		}
+
+		id, lineCh := watcher.Subscribe()
+		defer watcher.Unsubscribe(id)
+		droppedBefore := watcher.globalHub.droppedCount()
+
+		timeoutCh := time.After(time.Duration(timeout) * time.Second)
+
+		for {
+			select {
+			case line := <-lineCh:
+				for index, re := range patterns {
+					if m := re.FindStringSubmatch(line); m != nil {
+						L.Push(lua.LNumber(index))
+						L.Push(capturesToTable(L, m))
+						return 2
+					}
+				}
+			case <-timeoutCh:
+				warnDroppedLines("expectAnyRegex(...)", watcher.globalHub.droppedCount()-droppedBefore)
+				L.Push(lua.LNumber(-1))
+				return 1
+			case <-s.Done():
+				L.Push(lua.LNumber(-1))
+				return 1
+			}
+		}
+	}))
+
+	//-------------------------------------------------------------------------
+	// match
+	//-------------------------------------------------------------------------
+	L.SetGlobal("match", L.NewFunction(func(L *lua.LState) int {
+		line := L.CheckString(1)
+		pattern := L.CheckString(2)
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			L.RaiseError("invalid regex %q: %v", pattern, err)
+			return 0
+		}
+
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			L.Push(lua.LBool(false))
+			return 1
+		}
+		L.Push(lua.LBool(true))
+		L.Push(capturesToTable(L, m))
+		return 2
+	}))
+
+	//-------------------------------------------------------------------------
+	// peek
+	//-------------------------------------------------------------------------
+	L.SetGlobal("peek", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+
+		line, ok := watcher.Peek(windowName)
+		if !ok {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(lua.LString(line))
+		return 1
+	}))
+
+	//-------------------------------------------------------------------------
+	// droppedLines
+	//-------------------------------------------------------------------------
+	// droppedLines(windowName) returns how many lines were discarded because
+	// a subscriber's buffer was full during a burst: that window's own
+	// subscribers' drops plus the all-window subscribers' drops, which count
+	// lines from every window. expect
+	// and friends check this on timeout and print a warning, but a script can
+	// also poll it directly to tell a genuine no-match from lost output.
+	L.SetGlobal("droppedLines", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		L.Push(lua.LNumber(watcher.DroppedLines(windowName)))
+		return 1
+	}))
+
+	//-------------------------------------------------------------------------
+	// reopen
+	//-------------------------------------------------------------------------
+	L.SetGlobal("reopen", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		watcher.Reopen(windowName)
+		return 0
+	}))
+
+	//-------------------------------------------------------------------------
+	// reset
+	//-------------------------------------------------------------------------
+	L.SetGlobal("reset", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		watcher.Reset(windowName)
+		return 0
+	}))
+
+	//-------------------------------------------------------------------------
+	// approve
+	//-------------------------------------------------------------------------
+	L.SetGlobal("approve", L.NewFunction(func(L *lua.LState) int {
+		windowName := L.CheckString(1)
+		label := L.CheckString(2)
+
+		received := removeANSIEscapeSequences(watcher.Snapshot(windowName))
+		watcher.Reset(windowName)
+
+		goldenPath := filepath.Join("testdata", fmt.Sprintf("%s.%s.approved.txt", s.scriptBase, label))
+
+		approved, err := os.ReadFile(goldenPath)
+		if updateApproved || os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+				L.RaiseError("approve: failed to create %s: %v", filepath.Dir(goldenPath), err)
+				return 0
+			}
+			if err := os.WriteFile(goldenPath, []byte(received), 0o644); err != nil {
+				L.RaiseError("approve: failed to write %s: %v", goldenPath, err)
+				return 0
+			}
+			L.Push(lua.LBool(true))
+			return 1
+		}
+		if err != nil {
+			L.RaiseError("approve: failed to read %s: %v", goldenPath, err)
+			return 0
+		}
+
+		if string(approved) == received {
+			L.Push(lua.LBool(true))
+			return 1
+		}
+
+		fmt.Printf("approve('%s', '%s'): output does not match %s\n", windowName, label, goldenPath)
+		fmt.Print(diffLines(strings.Split(string(approved), "\n"), strings.Split(received, "\n")))
+
+		watcher.Close()
+		watcher.Flush(os.Stdout)
+		s.terminate(1)
+
+		L.RaiseError("texpect: approve('%s', '%s') mismatch", windowName, label)
+		return 0
+	}))
+
 	//-------------------------------------------------------------------------
 	// sleep
 	//-------------------------------------------------------------------------
@@ -312,11 +1457,37 @@ func registerAPI(L *lua.LState, watcher *LineWatcher) {
 		return 0
 	}))
 
+	//-------------------------------------------------------------------------
+	// onExit
+	//-------------------------------------------------------------------------
+	L.SetGlobal("onExit", L.NewFunction(func(L *lua.LState) int {
+		fn := L.CheckFunction(1)
+		onExitMu.Lock()
+		onExitFns = append(onExitFns, fn)
+		onExitMu.Unlock()
+		return 0
+	}))
+
 	//-------------------------------------------------------------------------
 	// exit
 	//-------------------------------------------------------------------------
 	L.SetGlobal("exit", L.NewFunction(func(L *lua.LState) int {
-		exec.Command("tmux", "kill-session").Run()
+		code := L.OptInt(1, 0)
+
+		onExitMu.Lock()
+		fns := append([]*lua.LFunction(nil), onExitFns...)
+		onExitMu.Unlock()
+		for _, fn := range fns {
+			if err := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}); err != nil {
+				fmt.Println("onExit handler failed:", err)
+			}
+		}
+
+		watcher.Close()
+		watcher.Flush(os.Stdout)
+		s.terminate(code)
+
+		L.RaiseError("texpect: exit(%d)", code)
 		return 0
 	}))
 }
@@ -336,7 +1507,8 @@ func example() {
 	win1.SendCommand("echo 'Hello from script1'")
 	win2.SendCommand("echo 'Hello from script2'")
 
-	for line := range lineWatcher.GetLineCh() {
+	_, lineCh := lineWatcher.Subscribe()
+	for line := range lineCh {
 		fmt.Print(line)
 	}
 
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCapturesToTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		match []string
+		want  []string
+	}{
+		{
+			name:  "single capture group",
+			match: []string{"job 42 done", "42"},
+			want:  []string{"42"},
+		},
+		{
+			name:  "multiple capture groups",
+			match: []string{"42:ok", "42", "ok"},
+			want:  []string{"42", "ok"},
+		},
+		{
+			name:  "no capture groups",
+			match: []string{"job done"},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			L := lua.NewState()
+			defer L.Close()
+
+			tbl := capturesToTable(L, tt.match)
+			if got, want := tbl.Len(), len(tt.want); got != want {
+				t.Fatalf("table length = %d, want %d", got, want)
+			}
+			for i, want := range tt.want {
+				got := tbl.RawGetInt(i + 1).String()
+				if got != want {
+					t.Errorf("captures[%d] = %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitFlushedLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		flushed   int
+		wantFull  string
+		wantChunk string
+	}{
+		{
+			name:      "nothing flushed yet",
+			raw:       "password:",
+			flushed:   0,
+			wantFull:  "password:",
+			wantChunk: "password:",
+		},
+		{
+			name:      "remainder after an earlier idle flush",
+			raw:       "password:done\n",
+			flushed:   len("password:"),
+			wantFull:  "password:done\n",
+			wantChunk: "done\n",
+		},
+		{
+			name:      "fully flushed, nothing new",
+			raw:       "password:",
+			flushed:   len("password:"),
+			wantFull:  "password:",
+			wantChunk: "",
+		},
+		{
+			name:      "ANSI escapes stripped from both full and chunk",
+			raw:       "\x1b[32mpass\x1b[0mword:",
+			flushed:   len("\x1b[32mpass\x1b[0m"),
+			wantFull:  "password:",
+			wantChunk: "word:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full, chunk := splitFlushedLine(tt.raw, tt.flushed)
+			if full != tt.wantFull {
+				t.Errorf("full = %q, want %q", full, tt.wantFull)
+			}
+			if chunk != tt.wantChunk {
+				t.Errorf("chunk = %q, want %q", chunk, tt.wantChunk)
+			}
+		})
+	}
+}
+
+func TestStatFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	if err := os.WriteFile(path, []byte("hello\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	state, err := statFile(path)
+	if err != nil {
+		t.Fatalf("statFile: %v", err)
+	}
+	if state.size != int64(len("hello\n")) {
+		t.Errorf("size = %d, want %d", state.size, len("hello\n"))
+	}
+	if state.ino == 0 {
+		t.Errorf("ino = 0, want a populated inode")
+	}
+
+	if _, err := statFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("statFile on a missing path: got nil error, want non-nil")
+	}
+}
+
+func TestRotated(t *testing.T) {
+	base := fileState{ino: 1, size: 100}
+
+	tests := []struct {
+		name string
+		next fileState
+		want bool
+	}{
+		{"same file, more data", fileState{ino: 1, size: 200}, false},
+		{"same file, unchanged", fileState{ino: 1, size: 100}, false},
+		{"same inode, truncated", fileState{ino: 1, size: 0}, true},
+		{"recreated under a new inode", fileState{ino: 2, size: 100}, true},
+		{"recreated smaller under a new inode", fileState{ino: 2, size: 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rotated(base, tt.next); got != tt.want {
+				t.Errorf("rotated(%+v, %+v) = %v, want %v", base, tt.next, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		old  []string
+		new  []string
+		want string
+	}{
+		{
+			name: "identical",
+			old:  []string{"a", "b"},
+			new:  []string{"a", "b"},
+			want: "  a\n  b\n",
+		},
+		{
+			name: "single line changed",
+			old:  []string{"a", "b", "c"},
+			new:  []string{"a", "x", "c"},
+			want: "  a\n- b\n+ x\n  c\n",
+		},
+		{
+			name: "appended lines",
+			old:  []string{"a"},
+			new:  []string{"a", "b"},
+			want: "  a\n+ b\n",
+		},
+		{
+			name: "removed lines",
+			old:  []string{"a", "b"},
+			new:  []string{"a"},
+			want: "  a\n- b\n",
+		},
+		{
+			name: "both empty",
+			old:  nil,
+			new:  nil,
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(tt.old, tt.new); got != tt.want {
+				t.Errorf("diffLines(%v, %v) = %q, want %q", tt.old, tt.new, got, tt.want)
+			}
+		})
+	}
+}